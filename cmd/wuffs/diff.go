@@ -0,0 +1,175 @@
+// Copyright 2017 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxDiffCells bounds the line-by-line LCS diff's O(n*m) table. Generated C
+// files can run to tens of thousands of lines; above this many cells we
+// skip the full diff rather than pay for (and hold in memory) a huge table.
+const maxDiffCells = 4000000
+
+// maxDiffHunks caps how many changed chunks printDiff prints, so that a
+// compiler change touching most of gen/c/std/*.c doesn't flood stdout.
+const maxDiffHunks = 20
+
+// diffContextLines is how many unchanged lines of context printDiff shows
+// on either side of a change, matching what a "git diff" reader expects.
+// Changes closer together than twice this are merged into one hunk.
+const diffContextLines = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'.
+	line string
+}
+
+// printDiff writes a compact, git-diff-like (but not line-numbered or
+// @@-hunk-headered) rendering of the changes between oldData and newData to
+// w, for human review of what a "wuffs gen" run is about to overwrite.
+func printDiff(w io.Writer, filename string, oldData []byte, newData []byte) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", filename, filename)
+
+	oldLines := splitLines(oldData)
+	newLines := splitLines(newData)
+	if len(oldLines)*len(newLines) > maxDiffCells {
+		fmt.Fprintln(w, "(diff suppressed: file too large)")
+		return
+	}
+
+	hunks := diffHunks(oldLines, newLines)
+	for i, hunk := range hunks {
+		if i >= maxDiffHunks {
+			fmt.Fprintf(w, "... (%d more differing chunk(s) omitted)\n", len(hunks)-maxDiffHunks)
+			break
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "...")
+		}
+		for _, op := range hunk {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+	}
+}
+
+// diffHunks groups the edit script for a and b into hunks: runs of
+// insertions and/or deletions padded with up to diffContextLines unchanged
+// lines of context on either side, merging hunks whose context would
+// otherwise overlap.
+func diffHunks(a []string, b []string) [][]diffOp {
+	ops := diffLines(a, b)
+
+	var changed []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var hunks [][]diffOp
+	start, end := changed[0], changed[0]
+	for _, idx := range changed[1:] {
+		if idx-end <= 2*diffContextLines {
+			end = idx
+			continue
+		}
+		hunks = append(hunks, hunkWithContext(ops, start, end))
+		start, end = idx, idx
+	}
+	hunks = append(hunks, hunkWithContext(ops, start, end))
+	return hunks
+}
+
+// hunkWithContext returns ops[start:end+1] padded with up to
+// diffContextLines of surrounding context.
+func hunkWithContext(ops []diffOp, start int, end int) []diffOp {
+	lo := start - diffContextLines
+	if lo < 0 {
+		lo = 0
+	}
+	hi := end + diffContextLines
+	if hi > len(ops)-1 {
+		hi = len(ops) - 1
+	}
+	hunk := make([]diffOp, hi-lo+1)
+	copy(hunk, ops[lo:hi+1])
+	return hunk
+}
+
+// diffLines returns the edit script turning a into b, computed from the
+// longest common subsequence of the two line slices.
+func diffLines(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	testCases := []struct {
+		desc string
+		a    []string
+		b    []string
+		want []diffOp
+	}{{
+		desc: "identical",
+		a:    []string{"foo", "bar"},
+		b:    []string{"foo", "bar"},
+		want: []diffOp{{' ', "foo"}, {' ', "bar"}},
+	}, {
+		desc: "append",
+		a:    []string{"foo"},
+		b:    []string{"foo", "bar"},
+		want: []diffOp{{' ', "foo"}, {'+', "bar"}},
+	}, {
+		desc: "delete",
+		a:    []string{"foo", "bar"},
+		b:    []string{"foo"},
+		want: []diffOp{{' ', "foo"}, {'-', "bar"}},
+	}, {
+		desc: "replace middle line",
+		a:    []string{"foo", "bar", "baz"},
+		b:    []string{"foo", "qux", "baz"},
+		want: []diffOp{
+			{' ', "foo"},
+			{'-', "bar"},
+			{'+', "qux"},
+			{' ', "baz"},
+		},
+	}, {
+		desc: "both empty",
+		a:    nil,
+		b:    nil,
+		want: nil,
+	}}
+
+	for _, tc := range testCases {
+		if got := diffLines(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: diffLines(%q, %q) = %v, want %v", tc.desc, tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	a := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}
+	b := []string{"1", "2", "3", "4", "5x", "6", "7", "8", "9", "10"}
+
+	hunks := diffHunks(a, b)
+	if len(hunks) != 1 {
+		t.Fatalf("len(hunks) = %d, want 1", len(hunks))
+	}
+	// The lone change is line "5" -> "5x"; diffContextLines is 3 either
+	// side, so the hunk should span lines 2..8 (indices 1..7): "2".."8".
+	want := []diffOp{
+		{' ', "2"}, {' ', "3"}, {' ', "4"},
+		{'-', "5"}, {'+', "5x"},
+		{' ', "6"}, {' ', "7"}, {' ', "8"},
+	}
+	if !reflect.DeepEqual(hunks[0], want) {
+		t.Errorf("hunks[0] = %v, want %v", hunks[0], want)
+	}
+}
+
+func TestDiffHunksNoChange(t *testing.T) {
+	a := []string{"same", "same"}
+	if hunks := diffHunks(a, a); hunks != nil {
+		t.Errorf("diffHunks(a, a) = %v, want nil", hunks)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"foo", []string{"foo"}},
+		{"foo\n", []string{"foo"}},
+		{"foo\nbar", []string{"foo", "bar"}},
+		{"foo\nbar\n", []string{"foo", "bar"}},
+	}
+	for _, tc := range testCases {
+		if got := splitLines([]byte(tc.in)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitLines(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -16,14 +16,20 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 func doGen(wuffsRoot string, args []string) error    { return doGenGenlib(wuffsRoot, args, false) }
@@ -32,6 +38,11 @@ func doGenlib(wuffsRoot string, args []string) error { return doGenGenlib(wuffsR
 func doGenGenlib(wuffsRoot string, args []string, genlib bool) error {
 	flags := flag.NewFlagSet("gen", flag.ExitOnError)
 	langsFlag := flags.String("langs", langsDefault, langsUsage)
+	jFlag := flags.Int("j", runtime.NumCPU(), "number of gen jobs to run in parallel")
+	checkFlag := flags.Bool("check", false, "check that generated files are up to date, without writing")
+	diffFlag := flags.Bool("diff", false, "print a diff of each changed generated file before writing")
+	dryRunFlag := flags.Bool("dry-run", false, "generate but do not write any files")
+	regionTagsFlag := flags.Bool("region-tags", false, "wrap generated files in [START tag]/[END tag] region markers")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -43,10 +54,25 @@ func doGenGenlib(wuffsRoot string, args []string, genlib bool) error {
 	if len(args) == 0 {
 		args = []string{"std/..."}
 	}
+	jobCount := *jFlag
+	if jobCount < 1 {
+		jobCount = 1
+	}
+
+	manifest, err := loadGenManifest(wuffsRoot)
+	if err != nil {
+		return err
+	}
 
 	h := genHelper{
-		wuffsRoot: wuffsRoot,
-		langs:     langs,
+		wuffsRoot:  wuffsRoot,
+		langs:      langs,
+		jobCount:   jobCount,
+		check:      *checkFlag,
+		diff:       *diffFlag,
+		dryRun:     *dryRunFlag,
+		regionTags: *regionTagsFlag,
+		manifest:   manifest,
 	}
 
 	for _, arg := range args {
@@ -59,6 +85,33 @@ func doGenGenlib(wuffsRoot string, args []string, genlib bool) error {
 		}
 	}
 
+	if err := h.runJobs(); err != nil {
+		return err
+	}
+
+	if h.check {
+		var stale []string
+		for _, job := range h.jobs {
+			stale = append(stale, job.stale...)
+		}
+		if len(stale) > 0 {
+			fmt.Println("gen -check: stale generated files:")
+			for _, s := range stale {
+				fmt.Println("  ", s)
+			}
+			return fmt.Errorf("gen -check: %d stale generated file(s)", len(stale))
+		}
+		return nil
+	}
+
+	if h.dryRun {
+		return nil
+	}
+
+	if err := h.manifest.save(wuffsRoot); err != nil {
+		return err
+	}
+
 	if genlib {
 		return h.genlibAffected()
 	}
@@ -66,9 +119,35 @@ func doGenGenlib(wuffsRoot string, args []string, genlib bool) error {
 }
 
 type genHelper struct {
-	wuffsRoot string
-	langs     []string
-	affected  []string
+	wuffsRoot  string
+	langs      []string
+	jobCount   int
+	check      bool
+	diff       bool
+	dryRun     bool
+	regionTags bool
+
+	jobs []*genJob
+
+	affected   []string
+	affectedMu sync.Mutex
+
+	manifestMu sync.Mutex
+	manifest   genManifest
+	binDigests map[string][sha256.Size]byte
+}
+
+// genJob is one directory's worth of generation work. Jobs are discovered by
+// the single-threaded tree walk in genHelper.gen (so h.jobs is in a stable,
+// deterministic order) and then run concurrently by genHelper.runJobs. Each
+// job buffers its own "gen wrote:" / "gen unchanged:" / "gen cached:" lines
+// in buf so that, however the jobs interleave at runtime, runJobs can flush
+// them to stdout in tree-walk order.
+type genJob struct {
+	dirname   string
+	filenames []string
+	buf       bytes.Buffer
+	stale     []string
 }
 
 func (h *genHelper) gen(dirname string, recursive bool) error {
@@ -77,10 +156,7 @@ func (h *genHelper) gen(dirname string, recursive bool) error {
 		return err
 	}
 	if len(filenames) > 0 {
-		if err := h.genDir(dirname, filenames); err != nil {
-			return err
-		}
-		h.affected = append(h.affected, dirname)
+		h.jobs = append(h.jobs, &genJob{dirname: dirname, filenames: filenames})
 	}
 	if len(dirnames) > 0 {
 		for _, d := range dirnames {
@@ -92,71 +168,244 @@ func (h *genHelper) gen(dirname string, recursive bool) error {
 	return nil
 }
 
-func (h *genHelper) genDir(dirname string, filenames []string) error {
-	// TODO: skip the generation if the output file already exists and its
-	// mtime is newer than all inputs and the wuffs-gen-foo command.
+// runJobs runs h.jobs across h.jobCount workers, stops launching new jobs
+// once the first failure is seen, and then flushes every job's buffered
+// output to stdout in tree-walk order.
+func (h *genHelper) runJobs() error {
+	sem := make(chan struct{}, h.jobCount)
+	var wg sync.WaitGroup
+	errs := &onceError{}
+
+	for _, job := range h.jobs {
+		if errs.load() != nil {
+			break
+		}
+		job := job
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if errs.load() != nil {
+				return
+			}
+			if err := h.genDir(job); err != nil {
+				errs.store(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, job := range h.jobs {
+		io.Copy(os.Stdout, &job.buf)
+	}
+	return errs.load()
+}
 
+func (h *genHelper) genDir(job *genJob) error {
+	dirname, filenames := job.dirname, job.filenames
 	packageName := path.Base(dirname)
 	if !validName(packageName) {
 		return fmt.Errorf(`invalid package %q, not in [a-z0-9]+`, packageName)
 	}
-	cmdArgs := []string{"gen", "-package_name", packageName}
-	for _, filename := range filenames {
-		cmdArgs = append(cmdArgs,
-			filepath.Join(h.wuffsRoot, filepath.FromSlash(dirname), filename))
+	inputs := make([]string, len(filenames))
+	for i, filename := range filenames {
+		inputs[i] = filepath.Join(h.wuffsRoot, filepath.FromSlash(dirname), filename)
 	}
 
-	for _, lang := range h.langs {
-		command := "wuffs-" + lang
-		stdout := &bytes.Buffer{}
-		cmd := exec.Command(command, cmdArgs...)
-		cmd.Stdin = nil
-		cmd.Stdout = stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err == nil {
-			// No-op.
-		} else if _, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("%s: failed", command)
-		} else {
-			return err
-		}
-		out := stdout.Bytes()
-		if err := h.genFile(dirname, lang, out); err != nil {
-			return err
-		}
-
-		// Special-case the "c" generator to also write a .h file.
-		if lang != "c" {
-			continue
-		}
-		if i := bytes.Index(out, cHeaderEndsHere); i < 0 {
-			return fmt.Errorf("%s: output did not contain %q", command, cHeaderEndsHere)
-		} else {
-			out = out[:i]
-		}
-		if err := h.genFile(dirname, "h", out); err != nil {
-			return err
-		}
+	// Run the per-lang generators concurrently, but write each lang's
+	// output into its own buffer so that job.buf ends up in h.langs order
+	// regardless of which generator finishes first.
+	bufs := make([]bytes.Buffer, len(h.langs))
+	staleLists := make([][]string, len(h.langs))
+	errs := &onceError{}
+	var wg sync.WaitGroup
+	for i, lang := range h.langs {
+		i, lang := i, lang
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stale, err := h.genLang(&bufs[i], dirname, lang, packageName, filenames, inputs)
+			if err != nil {
+				errs.store(err)
+				return
+			}
+			staleLists[i] = stale
+		}()
+	}
+	wg.Wait()
+	for i := range bufs {
+		job.buf.Write(bufs[i].Bytes())
+		job.stale = append(job.stale, staleLists[i]...)
+	}
+	if err := errs.load(); err != nil {
+		return err
 	}
+
+	h.affectedMu.Lock()
+	h.affected = append(h.affected, dirname)
+	h.affectedMu.Unlock()
 	return nil
 }
 
+func (h *genHelper) genLang(w io.Writer, dirname string, lang string, packageName string, filenames []string, inputs []string) ([]string, error) {
+	outFilename := filepath.Join(h.wuffsRoot, "gen", lang, filepath.FromSlash(dirname)+"."+lang)
+	hOutFilename := filepath.Join(h.wuffsRoot, "gen", "h", filepath.FromSlash(dirname)+".h")
+
+	inputDigest, err := h.inputDigest(dirname, filenames, packageName, lang)
+	if err != nil {
+		return nil, err
+	}
+	if !h.check && !h.dryRun && h.cacheHit(outFilename, inputDigest) && (lang != "c" || h.cacheHit(hOutFilename, inputDigest)) {
+		fmt.Fprintln(w, "gen cached:    ", outFilename)
+		return nil, nil
+	}
+
+	out, err := generatorFor(lang).Generate(packageName, inputs)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	s, err := h.genFile(w, outFilename, out, inputDigest, regionTagFor(dirname, lang))
+	if err != nil {
+		return nil, err
+	}
+	if s != "" {
+		stale = append(stale, s)
+	}
+
+	// Special-case the "c" generator to also write a .h file.
+	if lang != "c" {
+		return stale, nil
+	}
+	if i := bytes.Index(out, cHeaderEndsHere); i < 0 {
+		return nil, fmt.Errorf("wuffs-%s: output did not contain %q", lang, cHeaderEndsHere)
+	} else {
+		out = out[:i]
+	}
+	s, err = h.genFile(w, hOutFilename, out, inputDigest, regionTagFor(dirname, "h"))
+	if err != nil {
+		return nil, err
+	}
+	if s != "" {
+		stale = append(stale, s)
+	}
+	return stale, nil
+}
+
 var cHeaderEndsHere = []byte("\n// C HEADER ENDS HERE.\n\n")
 
-func (h *genHelper) genFile(dirname string, lang string, out []byte) error {
-	outFilename := filepath.Join(h.wuffsRoot, "gen", lang, filepath.FromSlash(dirname)+"."+lang)
-	if existing, err := ioutil.ReadFile(outFilename); err == nil && bytes.Equal(existing, out) {
-		fmt.Println("gen unchanged: ", outFilename)
-		return nil
+// Generator produces the generated source code for one Wuffs package in one
+// target language. Generate is called with the package's name and the
+// absolute paths of its input .wuffs files, and returns the generated bytes
+// (for the "c" lang, including the leading header half that precedes
+// cHeaderEndsHere and is split out into the .h file).
+type Generator interface {
+	Generate(pkgName string, inputs []string) ([]byte, error)
+}
+
+var (
+	generatorsMu sync.Mutex
+	generators   = map[string]Generator{}
+)
+
+// RegisterGenerator installs an in-process Generator for lang, so that
+// "wuffs gen -langs lang" uses it instead of shelling out to a wuffs-<lang>
+// binary found on PATH. This lets downstream users embed backends (e.g. for
+// Rust, Zig or WASM) as libraries, with structured errors and no subprocess
+// overhead, without needing to register a new lang tag anywhere else.
+func RegisterGenerator(lang string, g Generator) {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+	generators[lang] = g
+}
+
+func lookupGenerator(lang string) Generator {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+	return generators[lang]
+}
+
+// generatorFor returns the registered in-process Generator for lang, or the
+// default exec-based fallback (running a "wuffs-<lang>" binary on PATH) if
+// none was registered.
+func generatorFor(lang string) Generator {
+	if g := lookupGenerator(lang); g != nil {
+		return g
+	}
+	return execGenerator{lang: lang}
+}
+
+// execGenerator is the default Generator. It shells out to the
+// "wuffs-<lang>" binary on PATH, the same way wuffs gen has always worked.
+type execGenerator struct {
+	lang string
+}
+
+func (g execGenerator) Generate(pkgName string, inputs []string) ([]byte, error) {
+	command := "wuffs-" + g.lang
+	cmdArgs := append([]string{"gen", "-package_name", pkgName}, inputs...)
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command(command, cmdArgs...)
+	cmd.Stdin = nil
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err == nil {
+		// No-op.
+	} else if _, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("%s: failed", command)
+	} else {
+		return nil, err
 	}
+	return stdout.Bytes(), nil
+}
+
+// genFile reconciles the freshly generated out bytes with outFilename. In
+// -check mode, it never writes or MkdirAll's; it only compares, and returns
+// outFilename as stale if the file is missing or differs. Otherwise, if out
+// differs from the on-disk file, it optionally prints a diff (-diff) and
+// then either writes the change or, in -dry-run mode, reports it without
+// writing.
+func (h *genHelper) genFile(w io.Writer, outFilename string, out []byte, inputDigest string, regionTag string) (stale string, err error) {
+	if h.regionTags {
+		out = wrapRegionTags(regionTag, out)
+	}
+
+	existing, readErr := ioutil.ReadFile(outFilename)
+	upToDate := readErr == nil && bytes.Equal(existing, out)
+
+	if h.check {
+		if upToDate {
+			fmt.Fprintln(w, "gen check ok:  ", outFilename)
+			return "", nil
+		}
+		fmt.Fprintln(w, "gen check stale:", outFilename)
+		return outFilename, nil
+	}
+
+	if upToDate {
+		fmt.Fprintln(w, "gen unchanged: ", outFilename)
+		h.updateManifest(outFilename, inputDigest, out)
+		return "", nil
+	}
+
+	if h.diff {
+		printDiff(w, outFilename, existing, out)
+	}
+	if h.dryRun {
+		fmt.Fprintln(w, "gen dry-run:   ", outFilename)
+		return "", nil
+	}
+
 	if err := os.MkdirAll(filepath.Dir(outFilename), 0755); err != nil {
-		return err
+		return "", err
 	}
 	if err := ioutil.WriteFile(outFilename, out, 0644); err != nil {
-		return err
+		return "", err
 	}
-	fmt.Println("gen wrote:     ", outFilename)
-	return nil
+	fmt.Fprintln(w, "gen wrote:     ", outFilename)
+	h.updateManifest(outFilename, inputDigest, out)
+	return "", nil
 }
 
 func (h *genHelper) genlibAffected() error {
@@ -174,4 +423,186 @@ func (h *genHelper) genlibAffected() error {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// inputDigest hashes the concatenated bytes of dirname's input files, the
+// wuffs-<lang> binary (if lang has no registered in-process Generator), the
+// (packageName, lang) pair that parameterize the generator invocation, and
+// any flag that changes the bytes genFile ultimately writes (currently just
+// -region-tags). For a lang run through a wuffs-<lang> binary, two gen runs
+// that produce the same inputDigest for an output file are guaranteed to
+// produce byte-identical output.
+//
+// In-process generators have no on-disk binary to hash, so they're not
+// mixed into the digest; callers that change a registered Generator's
+// behavior between runs should delete gen/wuffs-gen.lock (or pass -check /
+// -dry-run) to force regeneration.
+func (h *genHelper) inputDigest(dirname string, filenames []string, packageName string, lang string) (string, error) {
+	var binDigest [sha256.Size]byte
+	if lookupGenerator(lang) == nil {
+		d, err := h.commandDigest(lang)
+		if err != nil {
+			return "", err
+		}
+		binDigest = d
+	}
+	hasher := sha256.New()
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filepath.Join(h.wuffsRoot, filepath.FromSlash(dirname), filename))
+		if err != nil {
+			return "", err
+		}
+		hasher.Write(data)
+	}
+	hasher.Write(binDigest[:])
+	fmt.Fprintf(hasher, "\x00%s\x00%s\x00region-tags=%t", packageName, lang, h.regionTags)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// commandDigest returns the SHA256 digest of the wuffs-<lang> binary found
+// on PATH, memoized per lang since genDir may be called concurrently across
+// many directories.
+func (h *genHelper) commandDigest(lang string) ([sha256.Size]byte, error) {
+	h.manifestMu.Lock()
+	defer h.manifestMu.Unlock()
+
+	if d, ok := h.binDigests[lang]; ok {
+		return d, nil
+	}
+	command := "wuffs-" + lang
+	binPath, err := exec.LookPath(command)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	data, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	d := sha256.Sum256(data)
+	if h.binDigests == nil {
+		h.binDigests = map[string][sha256.Size]byte{}
+	}
+	h.binDigests[lang] = d
+	return d, nil
+}
+
+// cacheHit reports whether outFilename already holds the output for
+// inputDigest, according to both the manifest and the file's current
+// contents on disk. Checking the on-disk digest (not just the manifest
+// entry) keeps the cache correct even if outFilename was edited or deleted
+// out from under wuffs gen.
+func (h *genHelper) cacheHit(outFilename string, inputDigest string) bool {
+	h.manifestMu.Lock()
+	entry, ok := h.manifest[h.manifestKey(outFilename)]
+	h.manifestMu.Unlock()
+	if !ok || entry.InputDigest != inputDigest {
+		return false
+	}
+	existing, err := ioutil.ReadFile(outFilename)
+	if err != nil {
+		return false
+	}
+	return sha256Hex(existing) == entry.OutputDigest
+}
+
+func (h *genHelper) updateManifest(outFilename string, inputDigest string, out []byte) {
+	h.manifestMu.Lock()
+	defer h.manifestMu.Unlock()
+
+	if h.manifest == nil {
+		h.manifest = genManifest{}
+	}
+	h.manifest[h.manifestKey(outFilename)] = genManifestEntry{
+		InputDigest:  inputDigest,
+		OutputDigest: sha256Hex(out),
+	}
+}
+
+// manifestKey turns an absolute outFilename into the path relative to
+// h.wuffsRoot (with forward slashes), so that the manifest, which is
+// committed alongside gen/, is keyed the same way on every checkout
+// regardless of where wuffsRoot happens to live on disk.
+func (h *genHelper) manifestKey(outFilename string) string {
+	rel, err := filepath.Rel(h.wuffsRoot, outFilename)
+	if err != nil {
+		return filepath.ToSlash(outFilename)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// genManifestEntry records, for one generated output file, the inputDigest
+// (see genHelper.inputDigest) and the SHA256 digest of the output bytes that
+// inputDigest produced. Keeping both lets cacheHit detect the output file
+// being hand-edited or deleted, not just the inputs changing.
+type genManifestEntry struct {
+	InputDigest  string
+	OutputDigest string
+}
+
+// genManifest is keyed by the output filename's path relative to wuffsRoot,
+// so that the manifest is portable across checkouts with different absolute
+// wuffsRoots. It is persisted as wuffsRoot/gen/wuffs-gen.lock so that
+// repeated "wuffs gen" invocations (including across fresh git checkouts,
+// where mtimes are unreliable) can skip subprocesses whose inputs haven't
+// changed.
+type genManifest map[string]genManifestEntry
+
+func genManifestFilename(wuffsRoot string) string {
+	return filepath.Join(wuffsRoot, "gen", "wuffs-gen.lock")
+}
+
+func loadGenManifest(wuffsRoot string) (genManifest, error) {
+	data, err := ioutil.ReadFile(genManifestFilename(wuffsRoot))
+	if os.IsNotExist(err) {
+		return genManifest{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := genManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m genManifest) save(wuffsRoot string) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	filename := genManifestFilename(wuffsRoot)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// onceError stores the first error reported to it via store, allowing
+// concurrent workers to race to record a failure without a data race.
+type onceError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (o *onceError) store(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+func (o *onceError) load() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
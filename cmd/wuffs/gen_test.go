@@ -0,0 +1,335 @@
+// Copyright 2017 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGenFileCheckModeRecordsStaleWithoutWriting checks that -check mode
+// never writes or MkdirAll's, and reports a missing or differing output as
+// stale while leaving an up-to-date output unreported.
+func TestGenFileCheckModeRecordsStaleWithoutWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wuffs-gen-test-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outFilename := filepath.Join(dir, "gen", "c", "std", "gzip.c")
+	h := &genHelper{wuffsRoot: dir, check: true, manifest: genManifest{}}
+
+	var buf bytes.Buffer
+	stale, err := h.genFile(&buf, outFilename, []byte("// generated\n"), "digest-v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != outFilename {
+		t.Errorf("genFile(-check, missing file) stale = %q, want %q", stale, outFilename)
+	}
+	if _, err := os.Stat(outFilename); !os.IsNotExist(err) {
+		t.Errorf("genFile(-check) must not create %s, but it exists", outFilename)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outFilename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outFilename, []byte("// generated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale, err = h.genFile(&buf, outFilename, []byte("// generated\n"), "digest-v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != "" {
+		t.Errorf("genFile(-check, up to date) stale = %q, want \"\"", stale)
+	}
+
+	if err := ioutil.WriteFile(outFilename, []byte("// edited by hand\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale, err = h.genFile(&buf, outFilename, []byte("// generated\n"), "digest-v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != outFilename {
+		t.Errorf("genFile(-check, differing file) stale = %q, want %q", stale, outFilename)
+	}
+}
+
+// TestCheckModeAggregatesStaleAndFails checks doGenGenlib's -check path: it
+// must exit with a non-nil error when any job reports a stale output, so
+// that "wuffs gen -check std/..." fails CI for an out-of-date tree.
+func TestCheckModeAggregatesStaleAndFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wuffs-gen-test-check-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const lang = "checkintegrationtest"
+	RegisterGenerator(lang, generatorFunc(func(pkgName string, inputs []string) ([]byte, error) {
+		return []byte("// " + pkgName + "\n"), nil
+	}))
+	defer delete(generators, lang)
+
+	full := filepath.Join(dir, "std", "gzip")
+	if err := os.MkdirAll(full, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(full, "gzip.wuffs"), []byte("pub status ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := doGenGenlib(dir, []string{"-check", "-langs", lang, "std/gzip"}, false); err == nil {
+		t.Error("doGenGenlib(-check) against a tree with no prior output = nil error, want non-nil")
+	}
+}
+
+func TestManifestKeyIsRelativeToWuffsRoot(t *testing.T) {
+	h := &genHelper{wuffsRoot: filepath.FromSlash("/a/b/wuffsroot")}
+	got := h.manifestKey(filepath.Join(h.wuffsRoot, "gen", "c", "std", "gzip.c"))
+	if want := "gen/c/std/gzip.c"; got != want {
+		t.Errorf("manifestKey = %q, want %q", got, want)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wuffs-gen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &genHelper{wuffsRoot: dir}
+	outFilename := filepath.Join(dir, "gen", "c", "std", "gzip.c")
+	if err := os.MkdirAll(filepath.Dir(outFilename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := []byte("// generated\n")
+	if err := ioutil.WriteFile(outFilename, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.updateManifest(outFilename, "digest-v1", out)
+
+	if !h.cacheHit(outFilename, "digest-v1") {
+		t.Error("cacheHit(same digest) = false, want true")
+	}
+	if h.cacheHit(outFilename, "digest-v2") {
+		t.Error("cacheHit(different digest) = true, want false")
+	}
+
+	// If the on-disk file no longer matches the recorded output digest
+	// (e.g. it was hand-edited), cacheHit must not trust the manifest.
+	if err := ioutil.WriteFile(outFilename, []byte("// edited by hand\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if h.cacheHit(outFilename, "digest-v1") {
+		t.Error("cacheHit(file edited on disk) = true, want false")
+	}
+}
+
+// TestCacheHitAcrossWuffsRoots checks that a manifest built under one
+// wuffsRoot still produces cache hits under a different wuffsRoot, so long
+// as the gen/... subtree underneath is identical. This is the scenario that
+// matters for gen/wuffs-gen.lock: it's committed and shared across clones
+// and CI machines that each have their own absolute wuffsRoot.
+func TestCacheHitAcrossWuffsRoots(t *testing.T) {
+	out := []byte("// generated\n")
+
+	dir1, err := ioutil.TempDir("", "wuffs-gen-test-root1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	out1 := filepath.Join(dir1, "gen", "c", "std", "gzip.c")
+	if err := os.MkdirAll(filepath.Dir(out1), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(out1, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h1 := &genHelper{wuffsRoot: dir1}
+	h1.updateManifest(out1, "digest-v1", out)
+
+	dir2, err := ioutil.TempDir("", "wuffs-gen-test-root2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+	out2 := filepath.Join(dir2, "gen", "c", "std", "gzip.c")
+	if err := os.MkdirAll(filepath.Dir(out2), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(out2, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h2 := &genHelper{wuffsRoot: dir2, manifest: h1.manifest}
+
+	if !h2.cacheHit(out2, "digest-v1") {
+		t.Error("cacheHit across a different wuffsRoot sharing a manifest = false, want true")
+	}
+}
+
+// TestGeneratorForPrefersRegisteredOverExecFallback checks that generatorFor
+// dispatches to an in-process Generator registered via RegisterGenerator,
+// instead of the default execGenerator fallback.
+func TestGeneratorForPrefersRegisteredOverExecFallback(t *testing.T) {
+	const lang = "registeredtest"
+	fake := fakeGenerator{}
+	RegisterGenerator(lang, fake)
+	defer delete(generators, lang)
+
+	if g := generatorFor(lang); g != Generator(fake) {
+		t.Errorf("generatorFor(%q) = %#v, want the registered fakeGenerator", lang, g)
+	}
+}
+
+// TestGeneratorForFallsBackToExecGenerator checks that generatorFor falls
+// back to execGenerator (shelling out to "wuffs-<lang>") for a lang with no
+// registered in-process Generator.
+func TestGeneratorForFallsBackToExecGenerator(t *testing.T) {
+	const lang = "unregisteredtest"
+	g := generatorFor(lang)
+	eg, ok := g.(execGenerator)
+	if !ok {
+		t.Fatalf("generatorFor(%q) = %T, want execGenerator", lang, g)
+	}
+	if eg.lang != lang {
+		t.Errorf("execGenerator.lang = %q, want %q", eg.lang, lang)
+	}
+}
+
+// generatorFunc adapts a plain function to the Generator interface, the way
+// http.HandlerFunc adapts a function to http.Handler.
+type generatorFunc func(pkgName string, inputs []string) ([]byte, error)
+
+func (f generatorFunc) Generate(pkgName string, inputs []string) ([]byte, error) {
+	return f(pkgName, inputs)
+}
+
+// TestRunJobsPreservesTreeWalkOrder checks that runJobs flushes each job's
+// buffered output in h.jobs (tree-walk) order, not completion order, even
+// when the jobs' generators finish out of order.
+func TestRunJobsPreservesTreeWalkOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wuffs-gen-test-runjobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const lang = "runjobstest"
+	var mu sync.Mutex
+	var completionOrder []string
+	RegisterGenerator(lang, generatorFunc(func(pkgName string, inputs []string) ([]byte, error) {
+		// Job "a" is first in tree-walk order but finishes last, so a naive
+		// print-as-you-complete scheme would print "b" and "c" before "a".
+		if pkgName == "a" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		mu.Lock()
+		completionOrder = append(completionOrder, pkgName)
+		mu.Unlock()
+		return []byte("// " + pkgName + "\n"), nil
+	}))
+	defer delete(generators, lang)
+
+	h := &genHelper{wuffsRoot: dir, langs: []string{lang}, jobCount: 3, manifest: genManifest{}}
+	for _, name := range []string{"a", "b", "c"} {
+		dirname := "std/" + name
+		full := filepath.Join(dir, filepath.FromSlash(dirname))
+		if err := os.MkdirAll(full, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(full, name+".wuffs"), []byte("pub status ok\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h.jobs = append(h.jobs, &genJob{dirname: dirname, filenames: []string{name + ".wuffs"}})
+	}
+
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	runErr := h.runJobs()
+	w.Close()
+	os.Stdout = oldStdout
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+
+	if len(completionOrder) != 3 || completionOrder[2] != "a" {
+		t.Fatalf("generator completion order = %v, want \"a\" last (otherwise this test doesn't exercise reordering)", completionOrder)
+	}
+
+	stdout := out.String()
+	ia := strings.Index(stdout, string(filepath.Separator)+"a.")
+	ib := strings.Index(stdout, string(filepath.Separator)+"b.")
+	ic := strings.Index(stdout, string(filepath.Separator)+"c.")
+	if ia < 0 || ib < 0 || ic < 0 || !(ia < ib && ib < ic) {
+		t.Errorf("flushed output order = %q, want a before b before c", stdout)
+	}
+}
+
+// fakeGenerator lets tests exercise inputDigest without a wuffs-<lang>
+// binary on PATH.
+type fakeGenerator struct{}
+
+func (fakeGenerator) Generate(pkgName string, inputs []string) ([]byte, error) {
+	return []byte("// " + pkgName + "\n"), nil
+}
+
+func TestInputDigestFoldsInRegionTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wuffs-gen-test-digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "std", "gzip"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wuffsFile := filepath.Join(dir, "std", "gzip", "gzip.wuffs")
+	if err := ioutil.WriteFile(wuffsFile, []byte("pub status ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterGenerator("gentest", fakeGenerator{})
+	defer delete(generators, "gentest")
+
+	plain, err := (&genHelper{wuffsRoot: dir}).inputDigest("std/gzip", []string{"gzip.wuffs"}, "gzip", "gentest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := (&genHelper{wuffsRoot: dir, regionTags: true}).inputDigest("std/gzip", []string{"gzip.wuffs"}, "gzip", "gentest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain == tagged {
+		t.Error("inputDigest is identical with and without -region-tags; " +
+			"a plain cached output would be wrongly reused once -region-tags is passed")
+	}
+}
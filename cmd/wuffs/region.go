@@ -0,0 +1,64 @@
+// Copyright 2017 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// licenseHeader is the Apache-2.0 boilerplate already at the top of every
+// file in this repo, injected into generated files (under -region-tags) for
+// generators that don't already emit one of their own.
+const licenseHeader = `// Copyright 2017 The Wuffs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+`
+
+// regionTagFor derives the region tag name for a generated output, e.g.
+// dirname "std/gzip" and lang "c" becomes "wuffs_std_gzip_c".
+func regionTagFor(dirname string, lang string) string {
+	return "wuffs_" + strings.Replace(dirname, "/", "_", -1) + "_" + lang
+}
+
+// wrapRegionTags wraps out with "// [START tag]" / "// [END tag]" markers,
+// so that external docs/tools can slice out per-package snippets from the
+// monolithic generated files without re-parsing them. It also prepends
+// licenseHeader, unless out already has one.
+func wrapRegionTags(tag string, out []byte) []byte {
+	buf := &bytes.Buffer{}
+	if !bytes.Contains(out, []byte("Licensed under the Apache License")) {
+		buf.WriteString(licenseHeader)
+	}
+	fmt.Fprintf(buf, "// [START %s]\n", tag)
+	buf.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(buf, "// [END %s]\n", tag)
+	return buf.Bytes()
+}